@@ -20,9 +20,11 @@ package java
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 
 	"github.com/google/blueprint"
+	"github.com/google/blueprint/proptools"
 
 	"android/soong"
 	"android/soong/android"
@@ -35,9 +37,11 @@ func init() {
 	soong.RegisterModuleType("java_library_host", JavaLibraryHostFactory)
 	soong.RegisterModuleType("java_binary", JavaBinaryFactory)
 	soong.RegisterModuleType("java_binary_host", JavaBinaryHostFactory)
+	soong.RegisterModuleType("java_plugin", JavaPluginFactory)
 	soong.RegisterModuleType("prebuilt_java_library", JavaPrebuiltFactory)
 	soong.RegisterModuleType("prebuilt_sdk", SdkPrebuiltFactory)
 	soong.RegisterModuleType("android_app", AndroidAppFactory)
+	soong.RegisterModuleType("java_system_modules", JavaSystemModulesFactory)
 
 	soong.RegisterSingletonType("logtags", LogtagsSingleton)
 }
@@ -78,6 +82,13 @@ type javaBaseProperties struct {
 	// list of module-specific flags that will be used for javac compiles
 	Javacflags []string `android:"arch_variant"`
 
+	// list of module-specific flags that will be used for kotlinc compiles
+	Kotlincflags []string `android:"arch_variant"`
+
+	// list of source files that should be shared between the host and device variants, in
+	// addition to Srcs.  May be .java or .kt files.
+	Common_srcs []string `android:"arch_variant"`
+
 	// list of module-specific flags that will be used for jack compiles
 	Jack_flags []string `android:"arch_variant"`
 
@@ -90,12 +101,23 @@ type javaBaseProperties struct {
 	// list of java libraries that will be compiled into the resulting jar
 	Java_static_libs []string `android:"arch_variant"`
 
+	// list of module-specific annotation processors to run in addition to standard ones
+	Plugins []string `android:"arch_variant"`
+
 	// manifest file to be included in resulting jar
 	Manifest *string
 
 	// if not blank, set to the version of the sdk to compile against
 	Sdk_version string
 
+	// the Java language level to compile for, e.g. "1.8", "9", "11", "17".  Sets -source and
+	// -target, and for "9" and above, selects --system over -bootclasspath.  Defaults to "1.8".
+	Java_version string
+
+	// the name of a java_system_modules module providing the --system image to compile
+	// against.  Only used when Java_version is "9" or higher.
+	System_modules string
+
 	// Set for device java libraries, and for host versions of device java libraries
 	// built for testing
 	Dex bool `blueprint:"mutated"`
@@ -109,6 +131,64 @@ type javaBaseProperties struct {
 	// directories that should be added as include directories
 	// for any aidl sources of modules that depend on this module
 	Export_aidl_include_dirs []string
+
+	// list of proguard flag files to export to any android_app that statically links this
+	// module, e.g. keep rules for classes only referenced via reflection.
+	Export_proguard_flags_files []string
+
+	// list of proguard rule files identifying classes that must be kept in the primary dex
+	// file when splitting into multiple dex files with Dex_preopt.Multidex: "legacy".  Exported
+	// to any android_app that statically links this module.
+	Main_dex_rules []string
+
+	Dex_preopt struct {
+		// whether and how to split the dex output into multiple dex files: "none" (the
+		// default) disables multidex; "native" relies on the platform's multidex support and
+		// requires Sdk_version to target API 21 or above; "legacy" uses a computed main-dex
+		// list so the module still loads on API levels below 21.
+		Multidex string
+	}
+
+	Optimize struct {
+		// if true, run proguard/r8 to shrink, optimize and obfuscate the jar before dexing.
+		// Defaults to false.
+		Enabled *bool
+
+		// if false, do not remove unreachable code.  Defaults to true when Enabled is set.
+		Shrink *bool
+
+		// if false, do not optimize bytecode.  Defaults to true when Enabled is set.
+		Optimize *bool
+
+		// if false, do not obfuscate class/method/field names.  Defaults to true when Enabled
+		// is set.
+		Obfuscate *bool
+
+		// list of proguard flag files to use in addition to the ones merged in from static
+		// dependencies and Export_proguard_flags_files of this module
+		Proguard_flags_files []string
+
+		// if true, use the proguard compatibility mode, disabling optimizations known to
+		// break reflection-heavy code.  Defaults to false.
+		Proguard_compatibility *bool
+	}
+
+	Errorprone struct {
+		// if true, run error-prone in addition to javac.  Defaults to false.
+		Enabled *bool
+
+		// list of javac flags that should only be used when running error-prone.
+		Javacflags []string
+	}
+
+	Jacoco struct {
+		// list of classes to include for instrumentation with jacoco to measure code coverage,
+		// using "**" as a wildcard, e.g. "com.foo.**"
+		Include_filter []string
+
+		// list of classes to exclude from jacoco instrumentation, overriding include_filter
+		Exclude_filter []string
+	}
 }
 
 // javaBase contains the properties and members used by all java module types, and implements
@@ -122,6 +202,11 @@ type javaBase struct {
 	// output file suitable for inserting into the classpath of another compile
 	classpathFile android.Path
 
+	// header jar (ABI-only, signatures but no method bodies) suitable for inserting into the
+	// classpath of another compile without forcing a rebuild when only implementation details
+	// of this module change
+	headerJarFile android.Path
+
 	// output file suitable for installing or running
 	outputFile android.Path
 
@@ -133,6 +218,14 @@ type javaBase struct {
 
 	exportAidlIncludeDirs android.Paths
 
+	// proguard flag files, from Export_proguard_flags_files, to propagate to any android_app
+	// that statically links this module
+	exportedProguardFlagFiles android.Paths
+
+	// main-dex rules files, from Main_dex_rules, to propagate to any android_app that
+	// statically links this module
+	exportedMainDexRulesFiles android.Paths
+
 	logtagsSrcs android.Paths
 
 	// filelists of extra source files that should be included in the javac command line,
@@ -145,6 +238,12 @@ type javaBase struct {
 
 type AndroidJavaModuleContext android.BaseContext
 
+// systemModulesDependency is implemented by java_system_modules, letting javaBase resolve its
+// --system boot dependency to a modules image directory instead of a classpath jar.
+type systemModulesDependency interface {
+	SystemModulesDir() android.Path
+}
+
 type JavaModuleType interface {
 	GenerateJavaBuildActions(ctx android.ModuleContext)
 	JavaDependencies(ctx AndroidJavaModuleContext) []string
@@ -152,9 +251,12 @@ type JavaModuleType interface {
 
 type JavaDependency interface {
 	ClasspathFile() android.Path
+	HeaderJar() android.Path
 	ClassJarSpecs() []jarSpec
 	ResourceJarSpecs() []jarSpec
 	AidlIncludeDirs() android.Paths
+	ExportedProguardFlags() android.Paths
+	ExportedMainDexRules() android.Paths
 }
 
 func NewJavaBase(base *javaBase, module JavaModuleType, hod android.HostOrDeviceSupported,
@@ -167,7 +269,36 @@ func NewJavaBase(base *javaBase, module JavaModuleType, hod android.HostOrDevice
 	return android.InitAndroidArchModule(base, hod, android.MultilibCommon, props...)
 }
 
+// useSystemModules returns true if Java_version selects a language level of 9 or higher, in
+// which case compilation uses --system against a java_system_modules image instead of the
+// classic -bootclasspath.
+func (j *javaBase) useSystemModules() bool {
+	switch j.properties.Java_version {
+	case "", "1.5", "1.6", "1.7", "1.8":
+		return false
+	default:
+		return true
+	}
+}
+
+// minSdkVersion returns the numeric API level that Sdk_version targets, or 10000 (the
+// "currently in development" level) if Sdk_version is blank or "current"/"system_current".
+func (j *javaBase) minSdkVersion() int {
+	switch j.properties.Sdk_version {
+	case "", "current", "system_current":
+		return 10000
+	default:
+		if v, err := strconv.Atoi(j.properties.Sdk_version); err == nil {
+			return v
+		}
+		return 0
+	}
+}
+
 func (j *javaBase) BootClasspath(ctx android.BaseContext) string {
+	if j.useSystemModules() {
+		return j.properties.System_modules
+	}
 	if ctx.Device() {
 		if j.properties.Sdk_version == "" {
 			return "core-libart"
@@ -191,6 +322,13 @@ func (j *javaBase) BootClasspath(ctx android.BaseContext) string {
 
 var defaultJavaLibraries = []string{"core-libart", "core-junit", "ext", "framework"}
 
+// jacocoInstrumentationEnabled returns whether offline jacoco instrumentation of dex'd modules
+// has been requested for this build, by setting either EMMA_INSTRUMENT or
+// EMMA_INSTRUMENT_STATIC.  Both variables enable the same instrumentation of every dex'd module.
+func jacocoInstrumentationEnabled(ctx android.BaseContext) bool {
+	return ctx.AConfig().Getenv("EMMA_INSTRUMENT_STATIC") != "" || ctx.AConfig().Getenv("EMMA_INSTRUMENT") != ""
+}
+
 func javaDepsMutator(ctx android.BottomUpMutatorContext) {
 	if j, ok := ctx.Module().(JavaModuleType); ok {
 		ctx.AddDependency(ctx.Module(), nil, j.JavaDependencies(ctx)...)
@@ -211,6 +349,14 @@ func (j *javaBase) JavaDependencies(ctx AndroidJavaModuleContext) []string {
 	}
 	deps = append(deps, j.properties.Java_libs...)
 	deps = append(deps, j.properties.Java_static_libs...)
+	deps = append(deps, j.properties.Plugins...)
+
+	if j.properties.Dex && jacocoInstrumentationEnabled(ctx) && ctx.ModuleName() != "jacocoagent" {
+		// Instrumented code calls into the jacoco runtime agent, so it needs to be linked into
+		// the dex'd output alongside the module's own classes.  The agent itself must not
+		// depend on itself.
+		deps = append(deps, "jacocoagent")
+	}
 
 	return deps
 }
@@ -235,21 +381,46 @@ func (j *javaBase) aidlFlags(ctx android.ModuleContext, aidlPreprocess android.O
 	return flags
 }
 
-func (j *javaBase) collectDeps(ctx android.ModuleContext) (classpath android.Paths,
-	bootClasspath android.OptionalPath, classJarSpecs, resourceJarSpecs []jarSpec, aidlPreprocess android.OptionalPath,
-	aidlIncludeDirs android.Paths, srcFileLists android.Paths) {
+func (j *javaBase) collectDeps(ctx android.ModuleContext) (classpath, fullClasspath, processorPath android.Paths,
+	bootClasspath, systemModules android.OptionalPath, classJarSpecs, resourceJarSpecs []jarSpec, aidlPreprocess android.OptionalPath,
+	aidlIncludeDirs, exportedProguardFlagsFiles, exportedMainDexRulesFiles, srcFileLists android.Paths) {
 
 	ctx.VisitDirectDeps(func(module blueprint.Module) {
 		otherName := ctx.OtherModuleName(module)
+
+		if otherName == j.BootClasspath(ctx) {
+			if sm, ok := module.(systemModulesDependency); ok {
+				systemModules = android.OptionalPathForPath(sm.SystemModulesDir())
+				return
+			}
+		}
+
 		if javaDep, ok := module.(JavaDependency); ok {
 			if otherName == j.BootClasspath(ctx) {
 				bootClasspath = android.OptionalPathForPath(javaDep.ClasspathFile())
 			} else if inList(otherName, defaultJavaLibraries) {
-				classpath = append(classpath, javaDep.ClasspathFile())
+				// Header jars only change when the public API changes, so compiling against
+				// them instead of the full implementation jar avoids rebuilding every
+				// dependent module whenever a private method changes.
+				classpath = append(classpath, javaDep.HeaderJar())
+				fullClasspath = append(fullClasspath, javaDep.ClasspathFile())
 			} else if inList(otherName, j.properties.Java_libs) {
-				classpath = append(classpath, javaDep.ClasspathFile())
+				classpath = append(classpath, javaDep.HeaderJar())
+				fullClasspath = append(fullClasspath, javaDep.ClasspathFile())
 			} else if inList(otherName, j.properties.Java_static_libs) {
-				classpath = append(classpath, javaDep.ClasspathFile())
+				classpath = append(classpath, javaDep.HeaderJar())
+				fullClasspath = append(fullClasspath, javaDep.ClasspathFile())
+				classJarSpecs = append(classJarSpecs, javaDep.ClassJarSpecs()...)
+				resourceJarSpecs = append(resourceJarSpecs, javaDep.ResourceJarSpecs()...)
+				exportedProguardFlagsFiles = append(exportedProguardFlagsFiles, javaDep.ExportedProguardFlags()...)
+				exportedMainDexRulesFiles = append(exportedMainDexRulesFiles, javaDep.ExportedMainDexRules()...)
+			} else if inList(otherName, j.properties.Plugins) {
+				// Annotation processors run against the full implementation jar, not the
+				// header jar, since they may inspect method bodies.
+				processorPath = append(processorPath, javaDep.ClasspathFile())
+			} else if otherName == "jacocoagent" {
+				classpath = append(classpath, javaDep.HeaderJar())
+				fullClasspath = append(fullClasspath, javaDep.ClasspathFile())
 				classJarSpecs = append(classJarSpecs, javaDep.ClassJarSpecs()...)
 				resourceJarSpecs = append(resourceJarSpecs, javaDep.ResourceJarSpecs()...)
 			} else if otherName == "framework-res" {
@@ -275,8 +446,8 @@ func (j *javaBase) collectDeps(ctx android.ModuleContext) (classpath android.Pat
 		}
 	})
 
-	return classpath, bootClasspath, classJarSpecs, resourceJarSpecs, aidlPreprocess,
-		aidlIncludeDirs, srcFileLists
+	return classpath, fullClasspath, processorPath, bootClasspath, systemModules, classJarSpecs, resourceJarSpecs, aidlPreprocess,
+		aidlIncludeDirs, exportedProguardFlagsFiles, exportedMainDexRulesFiles, srcFileLists
 }
 
 func (j *javaBase) GenerateAndroidBuildActions(ctx android.ModuleContext) {
@@ -285,10 +456,21 @@ func (j *javaBase) GenerateAndroidBuildActions(ctx android.ModuleContext) {
 
 func (j *javaBase) GenerateJavaBuildActions(ctx android.ModuleContext) {
 
+	if j.useSystemModules() && j.properties.System_modules == "" {
+		ctx.PropertyErrorf("system_modules",
+			"java_version %q requires system_modules to be set", j.properties.Java_version)
+		return
+	}
+
 	j.exportAidlIncludeDirs = android.PathsForModuleSrc(ctx, j.properties.Export_aidl_include_dirs)
 
-	classpath, bootClasspath, classJarSpecs, resourceJarSpecs, aidlPreprocess,
-		aidlIncludeDirs, srcFileLists := j.collectDeps(ctx)
+	classpath, fullClasspath, processorPath, bootClasspath, systemModules, classJarSpecs, resourceJarSpecs, aidlPreprocess,
+		aidlIncludeDirs, exportedProguardFlagsFiles, exportedMainDexRulesFiles, srcFileLists := j.collectDeps(ctx)
+
+	j.exportedProguardFlagFiles = append(android.PathsForModuleSrc(ctx, j.properties.Export_proguard_flags_files),
+		exportedProguardFlagsFiles...)
+	j.exportedMainDexRulesFiles = append(android.PathsForModuleSrc(ctx, j.properties.Main_dex_rules),
+		exportedMainDexRulesFiles...)
 
 	var flags javaBuilderFlags
 
@@ -306,17 +488,34 @@ func (j *javaBase) GenerateJavaBuildActions(ctx android.ModuleContext) {
 
 	var javacDeps android.Paths
 
-	if bootClasspath.Valid() {
+	if systemModules.Valid() {
+		flags.systemModules = "--system=" + systemModules.String()
+		javacDeps = append(javacDeps, systemModules.Path())
+	} else if bootClasspath.Valid() {
 		flags.bootClasspath = "-bootclasspath " + bootClasspath.String()
 		javacDeps = append(javacDeps, bootClasspath.Path())
 	}
 
+	javaVersion := j.properties.Java_version
+	if javaVersion == "" {
+		javaVersion = "1.8"
+	}
+	flags.javaVersion = "-source " + javaVersion + " -target " + javaVersion
+
 	if len(classpath) > 0 {
 		flags.classpath = "-classpath " + strings.Join(classpath.Strings(), ":")
 		javacDeps = append(javacDeps, classpath...)
 	}
 
+	if len(processorPath) > 0 {
+		flags.processorPath = "-processorpath " + strings.Join(processorPath.Strings(), ":")
+		javacDeps = append(javacDeps, processorPath...)
+	}
+
+	runErrorProne := proptools.Bool(j.properties.Errorprone.Enabled) || ctx.AConfig().Getenv("RUN_ERROR_PRONE") != ""
+
 	srcFiles := ctx.ExpandSources(j.properties.Srcs, j.properties.Exclude_srcs)
+	srcFiles = append(srcFiles, ctx.ExpandSources(j.properties.Common_srcs, nil)...)
 
 	srcFiles = j.genSources(ctx, srcFiles, flags)
 
@@ -328,14 +527,97 @@ func (j *javaBase) GenerateJavaBuildActions(ctx android.ModuleContext) {
 
 	srcFileLists = append(srcFileLists, j.ExtraSrcLists...)
 
-	if len(srcFiles) > 0 {
+	var kotlinSrcFiles, javaSrcFiles android.Paths
+	for _, srcFile := range srcFiles {
+		if strings.HasSuffix(srcFile.String(), ".kt") {
+			kotlinSrcFiles = append(kotlinSrcFiles, srcFile)
+		} else {
+			javaSrcFiles = append(javaSrcFiles, srcFile)
+		}
+	}
+
+	var headerJarSpecs []jarSpec
+
+	if len(kotlinSrcFiles) > 0 {
+		kotlincFlags := j.properties.Kotlincflags
+		if len(kotlincFlags) > 0 {
+			ctx.Variable(pctx, "kotlincFlags", strings.Join(kotlincFlags, " "))
+			flags.kotlincFlags = "$kotlincFlags"
+		}
+
+		// Compile the Kotlin sources against the same classpath as javac, with the Java
+		// sources of this module passed as friend paths so Kotlin can resolve symbols that
+		// are only defined in the Java sources it is paired with.
+		kotlinJar := TransformKotlinToClasses(ctx, kotlinSrcFiles, javaSrcFiles, flags, javacDeps)
+		if ctx.Failed() {
+			return
+		}
+
+		// Let javac see the Kotlin symbols by prepending the Kotlin class jar to -classpath.
+		if flags.classpath != "" {
+			flags.classpath = "-classpath " + kotlinJar.String() + ":" + strings.TrimPrefix(flags.classpath, "-classpath ")
+		} else {
+			flags.classpath = "-classpath " + kotlinJar.String()
+		}
+		javacDeps = append(javacDeps, kotlinJar)
+
+		kotlinJarSpec, _ := TransformPrebuiltJarToClasses(ctx, kotlinJar)
+		classJarSpecs = append([]jarSpec{kotlinJarSpec}, classJarSpecs...)
+
+		// Turbine can't parse Kotlin, so ijar the already-compiled Kotlin classes instead to
+		// get their ABI into the header jar.
+		kotlinHeaderJar := TransformJarToHeaderJar(ctx, kotlinJar)
+		if ctx.Failed() {
+			return
+		}
+		kotlinHeaderJarSpec, _ := TransformPrebuiltJarToClasses(ctx, kotlinHeaderJar)
+		headerJarSpecs = append(headerJarSpecs, kotlinHeaderJarSpec)
+	}
+
+	if len(javaSrcFiles) > 0 {
 		// Compile java sources into .class files
-		classes := TransformJavaToClasses(ctx, srcFiles, srcFileLists, flags, javacDeps)
+		classes := TransformJavaToClasses(ctx, javaSrcFiles, srcFileLists, flags, javacDeps)
 		if ctx.Failed() {
 			return
 		}
 
 		classJarSpecs = append([]jarSpec{classes}, classJarSpecs...)
+
+		// Run Turbine over the sources to produce an ABI-only jar containing only
+		// signatures, for other modules to compile against.
+		javaHeaderJar := TransformJavaToHeaderJar(ctx, javaSrcFiles, srcFileLists, flags, javacDeps)
+		if ctx.Failed() {
+			return
+		}
+		javaHeaderJarSpec, _ := TransformPrebuiltJarToClasses(ctx, javaHeaderJar)
+		headerJarSpecs = append(headerJarSpecs, javaHeaderJarSpec)
+
+		if runErrorProne {
+			errorproneFlags := flags
+			if len(j.properties.Errorprone.Javacflags) > 0 {
+				ctx.Variable(pctx, "errorproneJavacFlags", strings.Join(j.properties.Errorprone.Javacflags, " "))
+				errorproneFlags.javacFlags += " $errorproneJavacFlags"
+			}
+
+			// A separate javac invocation with error-prone's javac plugin enabled.  It doesn't
+			// produce anything the rest of the build depends on, only a timestamp file that
+			// CheckbuildFile can gate on, so a broken lint never blocks a normal build.
+			errorprone := TransformJavaToErrorProne(ctx, javaSrcFiles, srcFileLists, errorproneFlags, javacDeps)
+			if ctx.Failed() {
+				return
+			}
+			ctx.CheckbuildFile(errorprone)
+		}
+	}
+
+	if len(headerJarSpecs) > 0 {
+		// Merge the Java and Kotlin header jar contributions into one, the same way their
+		// full class jar specs are merged into classJarSpecs above, so that consumers see the
+		// complete ABI of the module regardless of which language a symbol came from.
+		j.headerJarFile = TransformClassesToJar(ctx, headerJarSpecs, android.OptionalPath{})
+		if ctx.Failed() {
+			return
+		}
 	}
 
 	resourceJarSpecs = append(ResourceDirsToJarSpecs(ctx, j.properties.Java_resource_dirs, j.properties.Exclude_java_resource_dirs),
@@ -367,17 +649,82 @@ func (j *javaBase) GenerateJavaBuildActions(ctx android.ModuleContext) {
 	j.resourceJarSpecs = resourceJarSpecs
 	j.classJarSpecs = classJarSpecs
 	j.classpathFile = outputFile
+	if j.headerJarFile == nil {
+		// No sources of our own (e.g. a pure re-export of static libs); the full jar is already
+		// just as cheap to depend on.
+		j.headerJarFile = outputFile
+	}
 
 	if j.properties.Dex && len(srcFiles) > 0 {
+		// Main-dex-list keep rules are written against the pre-obfuscation class names, so the
+		// main-dex-list computation below must run against this jar, not the one R8/Proguard
+		// may rename further down.
+		preOptimizeJar := outputFile
+
+		if proptools.Bool(j.properties.Optimize.Enabled) {
+			flagsFiles := android.PathsForModuleSrc(ctx, j.properties.Optimize.Proguard_flags_files)
+			flagsFiles = append(flagsFiles, j.exportedProguardFlagFiles...)
+
+			libraryJars := append(android.Paths(nil), fullClasspath...)
+			if bootClasspath.Valid() {
+				libraryJars = append(libraryJars, bootClasspath.Path())
+			}
+
+			var mapping android.Path
+			outputFile, mapping = TransformJarToOptimizedJar(ctx, outputFile, libraryJars, flagsFiles,
+				proptools.BoolDefault(j.properties.Optimize.Shrink, true),
+				proptools.BoolDefault(j.properties.Optimize.Optimize, true),
+				proptools.BoolDefault(j.properties.Optimize.Obfuscate, true),
+				proptools.Bool(j.properties.Optimize.Proguard_compatibility))
+			if ctx.Failed() {
+				return
+			}
+
+			ctx.InstallFileName(android.PathForModuleInstall(ctx, "proguard"),
+				ctx.ModuleName()+"-proguard-dict.txt", mapping)
+		}
+
+		if jacocoInstrumentationEnabled(ctx) {
+			// Offline-instrument the class jar with jacoco before dexing.  Unlike emma,
+			// jacoco preserves the local variable table of instrumented classes, so there's
+			// no need for dx's --no-locals workaround.
+			outputFile = TransformClassesJarToJacocoInstrumentedJar(ctx, outputFile,
+				j.properties.Jacoco.Include_filter, j.properties.Jacoco.Exclude_filter)
+			if ctx.Failed() {
+				return
+			}
+		}
+
 		dxFlags := j.properties.Dxflags
-		if false /* emma enabled */ {
-			// If you instrument class files that have local variable debug information in
-			// them emma does not correctly maintain the local variable table.
-			// This will cause an error when you try to convert the class files for Android.
-			// The workaround here is to build different dex file here based on emma switch
-			// then later copy into classes.dex. When emma is on, dx is run with --no-locals
-			// option to remove local variable information
-			dxFlags = append(dxFlags, "--no-locals")
+
+		switch j.properties.Dex_preopt.Multidex {
+		case "native":
+			if j.minSdkVersion() >= 21 {
+				dxFlags = append(dxFlags, "--multi-dex",
+					fmt.Sprintf("--min-sdk-version=%d", j.minSdkVersion()))
+			} else {
+				ctx.PropertyErrorf("dex_preopt.multidex",
+					"module requests native multidex but sdk_version %q does not resolve to API 21 or above",
+					j.properties.Sdk_version)
+			}
+		case "legacy":
+			mainDexRules := android.PathsForModuleSrc(ctx, j.properties.Main_dex_rules)
+			mainDexRules = append(mainDexRules, exportedMainDexRulesFiles...)
+
+			libraryJars := append(android.Paths(nil), fullClasspath...)
+			if bootClasspath.Valid() {
+				libraryJars = append(libraryJars, bootClasspath.Path())
+			}
+
+			// Classes that must live in classes.dex are found by running Proguard with
+			// shrinking only (no optimizing, renaming or preverifying) with -include set to the
+			// unioned main-dex rules, and noting what it decides to keep.
+			mainDexList := TransformJarToMainDexList(ctx, preOptimizeJar, libraryJars, mainDexRules)
+			if ctx.Failed() {
+				return
+			}
+
+			dxFlags = append(dxFlags, "--multi-dex", "--main-dex-list="+mainDexList.String())
 		}
 
 		if ctx.AConfig().Getenv("NO_OPTIMIZE_DX") != "" {
@@ -413,6 +760,10 @@ func (j *javaBase) ClasspathFile() android.Path {
 	return j.classpathFile
 }
 
+func (j *javaBase) HeaderJar() android.Path {
+	return j.headerJarFile
+}
+
 func (j *javaBase) ClassJarSpecs() []jarSpec {
 	return j.classJarSpecs
 }
@@ -425,6 +776,14 @@ func (j *javaBase) AidlIncludeDirs() android.Paths {
 	return j.exportAidlIncludeDirs
 }
 
+func (j *javaBase) ExportedProguardFlags() android.Paths {
+	return j.exportedProguardFlagFiles
+}
+
+func (j *javaBase) ExportedMainDexRules() android.Paths {
+	return j.exportedMainDexRulesFiles
+}
+
 var _ logtagsProducer = (*javaBase)(nil)
 
 func (j *javaBase) logtags() android.Paths {
@@ -459,6 +818,22 @@ func JavaLibraryHostFactory() (blueprint.Module, []interface{}) {
 	return NewJavaBase(&module.javaBase, module, android.HostSupported)
 }
 
+//
+// Java annotation processors (plugins)
+//
+
+// JavaPlugin is a JavaLibrary that additionally exposes its jar as an annotation processor,
+// for use via the Plugins property of other java modules.
+type JavaPlugin struct {
+	JavaLibrary
+}
+
+func JavaPluginFactory() (blueprint.Module, []interface{}) {
+	module := &JavaPlugin{}
+
+	return NewJavaBase(&module.javaBase, module, android.HostSupported)
+}
+
 //
 // Java Binaries (.jar file plus wrapper script)
 //
@@ -535,6 +910,11 @@ func (j *JavaPrebuilt) ClasspathFile() android.Path {
 	return j.classpathFile
 }
 
+func (j *JavaPrebuilt) HeaderJar() android.Path {
+	// Prebuilts are already stable artifacts; there's no implementation to strip out.
+	return j.classpathFile
+}
+
 func (j *JavaPrebuilt) ClassJarSpecs() []jarSpec {
 	return j.classJarSpecs
 }
@@ -547,6 +927,14 @@ func (j *JavaPrebuilt) AidlIncludeDirs() android.Paths {
 	return nil
 }
 
+func (j *JavaPrebuilt) ExportedProguardFlags() android.Paths {
+	return nil
+}
+
+func (j *JavaPrebuilt) ExportedMainDexRules() android.Paths {
+	return nil
+}
+
 func JavaPrebuiltFactory() (blueprint.Module, []interface{}) {
 	module := &JavaPrebuilt{}
 
@@ -594,6 +982,64 @@ func SdkPrebuiltFactory() (blueprint.Module, []interface{}) {
 		android.MultilibCommon, &module.properties, &module.sdkProperties)
 }
 
+//
+// Java system modules (--system image for javac 9+)
+//
+
+type javaSystemModulesProperties struct {
+	// list of java library and prebuilt jar modules whose jars should be packaged into the
+	// --system modules image, e.g. stub jars providing the public API surface of this image's
+	// target Java release
+	Libs []string
+}
+
+// JavaSystemModules packages a set of stub jars into a JDK-style --system modules image (a
+// lib/modules directory built with jmod/jlink) that javac 9+ can compile against instead of a
+// classic -bootclasspath.
+type JavaSystemModules struct {
+	android.ModuleBase
+
+	properties javaSystemModulesProperties
+
+	systemModulesDir android.Path
+}
+
+func (j *JavaSystemModules) SystemModulesDir() android.Path {
+	return j.systemModulesDir
+}
+
+func (j *JavaSystemModules) JavaDependencies(ctx AndroidJavaModuleContext) []string {
+	return j.properties.Libs
+}
+
+func (j *JavaSystemModules) GenerateAndroidBuildActions(ctx android.ModuleContext) {
+	j.GenerateJavaBuildActions(ctx)
+}
+
+func (j *JavaSystemModules) GenerateJavaBuildActions(ctx android.ModuleContext) {
+	var jars android.Paths
+
+	ctx.VisitDirectDeps(func(module blueprint.Module) {
+		if javaDep, ok := module.(JavaDependency); ok {
+			jars = append(jars, javaDep.ClasspathFile())
+		}
+	})
+
+	// Runs jmod to wrap each stub jar into a module, then jlink to link them into a single
+	// --system image directory.  The image is always built from the Libs jars; there is no
+	// way to point this module at an already unpacked prebuilt image.
+	j.systemModulesDir = TransformJarsToSystemModules(ctx, jars)
+}
+
+var _ JavaModuleType = (*JavaSystemModules)(nil)
+
+func JavaSystemModulesFactory() (blueprint.Module, []interface{}) {
+	module := &JavaSystemModules{}
+
+	return android.InitAndroidArchModule(module, android.HostAndDeviceSupported,
+		android.MultilibCommon, &module.properties)
+}
+
 func inList(s string, l []string) bool {
 	for _, e := range l {
 		if e == s {